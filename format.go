@@ -0,0 +1,134 @@
+// Copyright (c) 2011 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Preset Format strings.
+//
+// FormatJSON is a sentinel recognized by trace and rendered through a small
+// dedicated encoder rather than verb substitution, since JSON needs proper
+// escaping that a plain template can't give it.
+const (
+	FormatDefault = "%P%n: %m\n\tat %s:%d (%n)\n%A"
+	FormatCompact = "%P%f: %m (%s:%d)\n"
+	FormatLogfmt  = "ts=%t caller=%n file=%s:%d msg=%q\n"
+	FormatJSON    = "json"
+)
+
+// The verbs recognized by renderFormat:
+//	%n full function name, e.g. "github.com/santucco/trace.(*Tracer).Enter"
+//	%f short function name, e.g. "(*Tracer).Enter"
+//	%p package, e.g. "github.com/santucco/trace"
+//	%s source file
+//	%d line
+//	%m message
+//	%q message, quoted and escaped the way %q does in the fmt package
+//	%P prefix
+//	%g id of the goroutine that produced the record
+//	%t the record's timestamp, RFC3339Nano
+//	%A opts into printing the CallersSource frames below the record; expands
+//	   to nothing itself, the frames are appended by the sink after rendering
+//	%% a literal percent sign
+
+// splitPkgFunc splits a runtime function name such as
+// "github.com/santucco/trace.(*Tracer).Enter" into its package
+// ("github.com/santucco/trace") and short name ("(*Tracer).Enter").
+func splitPkgFunc(full string) (pkg, short string) {
+	slash := strings.LastIndexByte(full, '/')
+	dot := strings.IndexByte(full[slash+1:], '.')
+	if dot < 0 {
+		return "", full
+	}
+	dot += slash + 1
+	return full[:dot], full[dot+1:]
+}
+
+// renderFormat expands the % verbs in format using record. Unknown verbs are
+// left untouched so a typo doesn't silently swallow output.
+func renderFormat(format string, record Record) string {
+	pkg, short := splitPkgFunc(record.Function)
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'n':
+			b.WriteString(record.Function)
+		case 'f':
+			b.WriteString(short)
+		case 'p':
+			b.WriteString(pkg)
+		case 's':
+			b.WriteString(record.File)
+		case 'd':
+			b.WriteString(strconv.Itoa(record.Line))
+		case 'm':
+			b.WriteString(record.Message)
+		case 'q':
+			b.WriteString(strconv.Quote(record.Message))
+		case 'P':
+			b.WriteString(record.Prefix)
+		case 'g':
+			b.WriteString(strconv.FormatInt(record.Gid, 10))
+		case 't':
+			b.WriteString(record.Time.Format(time.RFC3339Nano))
+		case 'A':
+			// no output of its own, see the doc comment above
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
+
+// renderJSON encodes record as a single JSON object line.
+func renderJSON(record Record) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	b.WriteString(`"time":`)
+	b.WriteString(strconv.Quote(record.Time.Format(time.RFC3339Nano)))
+	b.WriteString(`,"prefix":`)
+	b.WriteString(strconv.Quote(record.Prefix))
+	b.WriteString(`,"func":`)
+	b.WriteString(strconv.Quote(record.Function))
+	b.WriteString(`,"file":`)
+	b.WriteString(strconv.Quote(record.File))
+	b.WriteString(`,"line":`)
+	b.WriteString(strconv.Itoa(record.Line))
+	b.WriteString(`,"gid":`)
+	b.WriteString(strconv.FormatInt(record.Gid, 10))
+	b.WriteString(`,"msg":`)
+	b.WriteString(strconv.Quote(record.Message))
+	if len(record.Frames) > 0 {
+		b.WriteString(`,"frames":[`)
+		for i, f := range record.Frames {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(`{"func":`)
+			b.WriteString(strconv.Quote(f.Function))
+			b.WriteString(`,"file":`)
+			b.WriteString(strconv.Quote(f.File))
+			b.WriteString(`,"line":`)
+			b.WriteString(strconv.Itoa(f.Line))
+			b.WriteByte('}')
+		}
+		b.WriteByte(']')
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2011 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+)
+
+// currentGoroutineID returns the id of the calling goroutine, parsed out of
+// the "goroutine N [state]:" header that runtime.Stack always writes first.
+func currentGoroutineID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(string(b[:i]), 10, 64)
+	return id
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2011 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import "sync/atomic"
+
+// adjustDepth changes the call-depth counter for gid by delta and returns
+// its new value. Once the counter returns to 0, its entry is removed so a
+// goroutine that has exited doesn't leak a depth counter forever.
+func (this *Tracer) adjustDepth(gid int64, delta int64) int64 {
+	v, _ := this.depth.LoadOrStore(gid, new(int64))
+	n := atomic.AddInt64(v.(*int64), delta)
+	if n <= 0 {
+		this.depth.Delete(gid)
+	}
+	return n
+}
+
+// currentDepth returns the call-depth counter for gid, 0 if Enter was never
+// called on it.
+func (this *Tracer) currentDepth(gid int64) int64 {
+	v, ok := this.depth.Load(gid)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(v.(*int64))
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2011 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiYellow = "\033[33m"
+	ansiGray   = "\033[90m"
+)
+
+var (
+	goroutineHeaderRe = regexp.MustCompile(`^goroutine (\d+) \[(.+)\]:$`)
+	pointerArgRe      = regexp.MustCompile(`0x[0-9a-fA-F]+\??`)
+)
+
+// PanicFrame is a single call or "created by" line of a parsed goroutine dump.
+type PanicFrame struct {
+	Function string // The function name, e.g. "main.foo"
+	Args     string // The raw argument list as printed by the runtime
+	File     string
+	Line     int
+}
+
+// PanicGoroutine is a parsed "goroutine N [state]:" block of a stack dump.
+// IDs holds more than one entry once goroutines with an identical stack have
+// been merged by aggregateGoroutines.
+type PanicGoroutine struct {
+	IDs       []int
+	State     string
+	Frames    []PanicFrame
+	CreatedBy *PanicFrame
+}
+
+// tracePanic captures the current goroutine dump (or, when PanicAggregate is
+// set, the dump of every goroutine), parses it and writes it to the
+// Tracer's sink in place of the plain "panic exit" line.
+func (this *Tracer) tracePanic() {
+	sink := this.Sink()
+	if sink == nil {
+		return
+	}
+	buf := make([]byte, 4096)
+	for {
+		if n := runtime.Stack(buf, this.PanicAggregate); n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	goroutines := parseGoroutineDump(buf)
+	if this.PanicAggregate {
+		goroutines = aggregateGoroutines(goroutines)
+	}
+	sink.Write(Record{
+		Level: Frame,
+		Time:  time.Now(),
+		Gid:   currentGoroutineID(),
+		Text:  formatGoroutines(this.Prefix, goroutines),
+	})
+}
+
+// parseGoroutineDump parses the standard format produced by runtime.Stack:
+//
+//	goroutine 1 [running]:
+//	main.foo(0xc000010018, 0x5)
+//		/path/to/file.go:20 +0x2b
+//	created by main.main
+//		/path/to/file.go:10 +0x35
+func parseGoroutineDump(dump []byte) []PanicGoroutine {
+	var goroutines []PanicGoroutine
+	var cur *PanicGoroutine
+	var pending string
+	scanner := bufio.NewScanner(bytes.NewReader(dump))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if m := goroutineHeaderRe.FindStringSubmatch(line); m != nil {
+			if cur != nil {
+				goroutines = append(goroutines, *cur)
+			}
+			id, _ := strconv.Atoi(m[1])
+			cur = &PanicGoroutine{IDs: []int{id}, State: m[2]}
+			pending = ""
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			if pending == "" {
+				continue
+			}
+			file, ln := splitFileLine(line)
+			created := strings.HasPrefix(pending, "created by ")
+			name, args := splitFuncArgs(strings.TrimPrefix(pending, "created by "))
+			frame := PanicFrame{Function: name, Args: args, File: file, Line: ln}
+			if created {
+				cur.CreatedBy = &frame
+			} else {
+				cur.Frames = append(cur.Frames, frame)
+			}
+			pending = ""
+			continue
+		}
+		pending = line
+	}
+	if cur != nil {
+		goroutines = append(goroutines, *cur)
+	}
+	return goroutines
+}
+
+// splitFuncArgs splits "pkg.Func(args)" into "pkg.Func" and "args". Lines
+// with no argument list, such as "created by pkg.Func", are returned as-is.
+func splitFuncArgs(s string) (name, args string) {
+	if !strings.HasSuffix(s, ")") {
+		return s, ""
+	}
+	i := strings.LastIndexByte(s, '(')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1 : len(s)-1]
+}
+
+// splitFileLine parses "\t/path/to/file.go:20 +0x2b" into the file and line.
+func splitFileLine(s string) (file string, line int) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		s = s[:i]
+	}
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return s, 0
+	}
+	line, _ = strconv.Atoi(s[i+1:])
+	return s[:i], line
+}
+
+// elideArgs replaces every pointer-looking value with "…" so that addresses,
+// which are meaningless and change on every run, don't clutter the output.
+// It matches inside aggregates too, e.g. "{0xc0001, 0x5}" becomes "{…, …}",
+// and tolerates the trailing "?" the runtime appends to inaccurate values,
+// e.g. "0xc000046e00?".
+func elideArgs(args string) string {
+	return pointerArgRe.ReplaceAllString(args, "…")
+}
+
+// aggregateGoroutines merges goroutines that share an identical stack (the
+// same frames and the same broad state, ignoring how long they've been in
+// it) into a single entry, the way panic-analysis tools do.
+func aggregateGoroutines(goroutines []PanicGoroutine) []PanicGoroutine {
+	groups := make(map[string]*PanicGoroutine)
+	var order []string
+	for _, g := range goroutines {
+		k := goroutineSignature(g)
+		if existing, ok := groups[k]; ok {
+			existing.IDs = append(existing.IDs, g.IDs...)
+			continue
+		}
+		gg := g
+		groups[k] = &gg
+		order = append(order, k)
+	}
+	merged := make([]PanicGoroutine, 0, len(order))
+	for _, k := range order {
+		merged = append(merged, *groups[k])
+	}
+	return merged
+}
+
+// goroutineSignature builds a grouping key from a goroutine's state class
+// and its call stack, ignoring the exact argument values.
+func goroutineSignature(g PanicGoroutine) string {
+	var b strings.Builder
+	if i := strings.IndexByte(g.State, ','); i >= 0 {
+		b.WriteString(g.State[:i])
+	} else {
+		b.WriteString(g.State)
+	}
+	for _, f := range g.Frames {
+		fmt.Fprintf(&b, "|%s@%s:%d", f.Function, f.File, f.Line)
+	}
+	if g.CreatedBy != nil {
+		fmt.Fprintf(&b, "|created@%s:%d", g.CreatedBy.File, g.CreatedBy.Line)
+	}
+	return b.String()
+}
+
+// formatGoroutines renders parsed goroutines as aligned, colorized text,
+// each line prefixed with prefix the way the rest of the package does.
+func formatGoroutines(prefix string, goroutines []PanicGoroutine) string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	for _, g := range goroutines {
+		header := fmt.Sprintf("goroutine %d", g.IDs[0])
+		if len(g.IDs) > 1 {
+			header = fmt.Sprintf("%d goroutines (e.g. %d)", len(g.IDs), g.IDs[0])
+		}
+		fmt.Fprintf(tw, "%s%s%s%s [%s]\n", prefix, ansiBold, header, ansiReset, g.State)
+		for _, f := range g.Frames {
+			fmt.Fprintf(tw, "%s\t%s%s%s(%s)\t%s%s:%d%s\n", prefix, ansiYellow, f.Function, ansiReset, elideArgs(f.Args), ansiGray, f.File, f.Line, ansiReset)
+		}
+		if f := g.CreatedBy; f != nil {
+			fmt.Fprintf(tw, "%s\tcreated by %s%s%s\t%s%s:%d%s\n", prefix, ansiYellow, f.Function, ansiReset, ansiGray, f.File, f.Line, ansiReset)
+		}
+	}
+	tw.Flush()
+	return buf.String()
+}
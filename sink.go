@@ -0,0 +1,351 @@
+// Copyright (c) 2011 Alexander Sychev. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StackFrame is one extra logical stack frame attached to a Record, beyond
+// the primary Function/File/Line, produced by CallersSource.
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// Record carries every field of a single trace line in structured form, so
+// a Sink can consume it without reparsing a formatted string.
+type Record struct {
+	Level    uint         // The trace level the record was emitted at
+	Time     time.Time    // When the record was created
+	Gid      int64        // The id of the goroutine that created it
+	Prefix   string       // The Tracer's Prefix at the time of the call, preceded by Indent once per call depth
+	Function string       // The full name of the traced function
+	File     string       // The source file of the traced function
+	Line     int          // The source line of the traced function
+	Message  string       // The trace message
+	Frames   []StackFrame // Extra logical frames, from CallersSource
+	Format   string       // The Tracer's Format at the time of the call ("" for the sink's default), or a plain one-line format for records traced without source
+	Text     string       // A pre-rendered block (used for panic dumps); when set, text sinks emit it verbatim
+}
+
+// Sink is the destination trace records are written to. A Tracer owns (or
+// references) one, see Tracer.SetSink and Tracer.Sink.
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// WriterSink formats records with Record.Format (falling back to Format,
+// then FormatDefault) and writes them to W.
+type WriterSink struct {
+	W      io.Writer
+	Format string
+
+	mu sync.Mutex
+}
+
+// NewWriterSink returns a WriterSink writing to w using FormatDefault.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{W: w}
+}
+
+func (this *WriterSink) render(record Record) string {
+	if record.Text != "" {
+		return record.Text
+	}
+	format := record.Format
+	if format == "" {
+		format = this.Format
+	}
+	if format == "" {
+		format = FormatDefault
+	}
+	if format == FormatJSON {
+		return renderJSON(record)
+	}
+	s := renderFormat(format, record)
+	if len(record.Frames) > 0 && strings.Contains(format, "%A") {
+		for _, f := range record.Frames {
+			s += renderFormat("\tat %s:%d (%n)\n", Record{Function: f.Function, File: f.File, Line: f.Line})
+		}
+	}
+	return s
+}
+
+// Write implements Sink.
+func (this *WriterSink) Write(record Record) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err := io.WriteString(this.W, this.render(record))
+	return err
+}
+
+// Close implements Sink. Closing the underlying writer is left to the
+// caller, since WriterSink doesn't know whether it owns it (os.Stderr, for
+// instance, shouldn't be closed).
+func (this *WriterSink) Close() error {
+	return nil
+}
+
+// RingSink keeps the last size records in memory, discarding older ones,
+// for post-mortem dumping from a signal handler after a crash.
+type RingSink struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	full    bool
+}
+
+// NewRingSink returns a RingSink holding up to size records.
+func NewRingSink(size int) *RingSink {
+	return &RingSink{records: make([]Record, size)}
+}
+
+// Write implements Sink.
+func (this *RingSink) Write(record Record) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.records[this.next] = record
+	this.next++
+	if this.next == len(this.records) {
+		this.next = 0
+		this.full = true
+	}
+	return nil
+}
+
+// Close implements Sink; the ring buffer needs no cleanup.
+func (this *RingSink) Close() error {
+	return nil
+}
+
+// Dump writes every buffered record, oldest first, to w formatted the way a
+// WriterSink would.
+func (this *RingSink) Dump(w io.Writer) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ws := NewWriterSink(w)
+	start, n := 0, this.next
+	if this.full {
+		start, n = this.next, len(this.records)
+	}
+	for i := 0; i < n; i++ {
+		if err := ws.Write(this.records[(start+i)%len(this.records)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyslogSink writes records to a net.Conn (typically dialed to a syslog
+// daemon) wrapped in an RFC 3164 header.
+type SyslogSink struct {
+	Conn     net.Conn
+	Tag      string
+	Facility int    // Defaults to 1 (user-level messages) when 0
+	Format   string // Used when Record.Format is "", FormatDefault when this is "" too
+
+	mu sync.Mutex
+}
+
+// NewSyslogSink returns a SyslogSink writing to conn under tag.
+func NewSyslogSink(conn net.Conn, tag string) *SyslogSink {
+	return &SyslogSink{Conn: conn, Tag: tag, Facility: 1}
+}
+
+// Write implements Sink.
+func (this *SyslogSink) Write(record Record) error {
+	format := record.Format
+	if format == "" {
+		format = this.Format
+	}
+	if format == "" {
+		format = FormatDefault
+	}
+	var body string
+	if record.Text != "" {
+		body = record.Text
+	} else if format == FormatJSON {
+		body = renderJSON(record)
+	} else {
+		body = renderFormat(format, record)
+		if strings.Contains(format, "%A") {
+			for _, f := range record.Frames {
+				body += renderFormat("\tat %s:%d (%n)\n", Record{Function: f.Function, File: f.File, Line: f.Line})
+			}
+		}
+	}
+	facility := this.Facility
+	if facility == 0 {
+		facility = 1
+	}
+	host, _ := os.Hostname()
+	pri := facility*8 + severity(record.Level)
+	line := fmt.Sprintf("<%d>%s %s %s: %s", pri, record.Time.Format(time.Stamp), host, this.Tag, body)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err := io.WriteString(this.Conn, line)
+	return err
+}
+
+// Close implements Sink by closing the underlying connection.
+func (this *SyslogSink) Close() error {
+	return this.Conn.Close()
+}
+
+// severity maps a trace level bitmask to a syslog severity; frame traces
+// (enter/exit/panic) are debug-level, everything else is informational.
+func severity(level uint) int {
+	if level&Frame != 0 {
+		return 7
+	}
+	return 6
+}
+
+// FanoutSink dispatches every record to each of Sinks in turn.
+type FanoutSink struct {
+	Sinks []Sink
+}
+
+// NewFanoutSink returns a FanoutSink dispatching to sinks.
+func NewFanoutSink(sinks ...Sink) *FanoutSink {
+	return &FanoutSink{Sinks: sinks}
+}
+
+// Write implements Sink, writing to every sink and returning the first
+// error encountered, if any.
+func (this *FanoutSink) Write(record Record) error {
+	var err error
+	for _, sink := range this.Sinks {
+		if e := sink.Write(record); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close implements Sink, closing every sink and returning the first error
+// encountered, if any.
+func (this *FanoutSink) Close() error {
+	var err error
+	for _, sink := range this.Sinks {
+		if e := sink.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// flusher is implemented by sinks that buffer records asynchronously, so
+// callers who need a record to have actually reached the underlying writer
+// (e.g. a panic dump, right before the process re-panics and may abort) can
+// block until the backlog up to that point has drained.
+type flusher interface {
+	Flush() error
+}
+
+// chanSink decouples Write from the sink it wraps by handing records to a
+// background goroutine, so tracing never blocks on I/O; this is what backs
+// the package's default stderr sink.
+type chanSink struct {
+	inner Sink
+	ch    chan chanMsg
+	done  chan struct{}
+}
+
+// chanMsg is either a record to write or, when flush is non-nil, a barrier
+// that loop closes once every record queued ahead of it has been written.
+type chanMsg struct {
+	record Record
+	flush  chan struct{}
+}
+
+func newChanSink(inner Sink, buf int) *chanSink {
+	this := &chanSink{inner: inner, ch: make(chan chanMsg, buf), done: make(chan struct{})}
+	go this.loop()
+	return this
+}
+
+func (this *chanSink) loop() {
+	for msg := range this.ch {
+		if msg.flush != nil {
+			close(msg.flush)
+			continue
+		}
+		this.inner.Write(msg.record)
+	}
+	close(this.done)
+}
+
+func (this *chanSink) Write(record Record) error {
+	this.ch <- chanMsg{record: record}
+	return nil
+}
+
+// Flush implements flusher: it blocks until every record queued ahead of the
+// call has reached the underlying sink.
+func (this *chanSink) Flush() error {
+	sig := make(chan struct{})
+	this.ch <- chanMsg{flush: sig}
+	<-sig
+	return nil
+}
+
+func (this *chanSink) Close() error {
+	close(this.ch)
+	<-this.done
+	return this.inner.Close()
+}
+
+var (
+	defaultMu   sync.Mutex
+	defaultSink Sink
+)
+
+// Start starts tracing: it installs the default stderr sink used by every
+// Tracer that hasn't called SetSink.
+func Start() {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultSink != nil {
+		return
+	}
+	defaultSink = newChanSink(NewWriterSink(os.Stderr), 10)
+}
+
+// Stop stops all tracing and waits until all buffered records are written.
+func Stop() {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultSink == nil {
+		return
+	}
+	defaultSink.Close()
+	defaultSink = nil
+}
+
+// SetSink makes this use sink instead of the package's default stderr sink.
+func (this *Tracer) SetSink(sink Sink) {
+	this.sink = sink
+}
+
+// Sink returns the Sink this currently writes to: the one set with SetSink,
+// or the package's default stderr sink otherwise.
+func (this *Tracer) Sink() Sink {
+	if this.sink != nil {
+		return this.sink
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultSink
+}
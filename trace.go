@@ -19,7 +19,7 @@
 //		tracer.Prefix = "prefix: "
 //		tracer.TraceSource = true // turn stack calls of trace on
 //		tracer.FrameSource = true // turn stack calls of Frames on
-//		tracer.CallersSource = 2  // depth of stack is 1
+//		tracer.CallersSource = 1  // print 1 extra caller frame beyond the primary one
 //	}
 // in a source code:
 //	func Foo(){
@@ -40,23 +40,29 @@
 //	}
 // a sample of produced traces:
 //	prefix: main.Foo: enter
-//	at /home/santucco/work/go/test/test.go:23
-//	at /home/santucco/work/go/test/test.go:34
-//	prefix: main.Foo: output only for debTrace level, tracer: trace.Tracer{TraceLevel:0x7, Prefix:"prefix: ", FrameSource:true, TraceSource:true, CallersSource:0x2}
-//	at /home/santucco/work/go/test/test.go:25
-//	at /home/santucco/work/go/test/test.go:34
-//	prefix: main.Foo: output only for debTrace|debThis level, tracer: trace.Tracer{TraceLevel:0x7, Prefix:"prefix: ", FrameSource:true, TraceSource:true, CallersSource:0x2}
-//	at /home/santucco/work/go/test/test.go:26
-//	at /home/santucco/work/go/test/test.go:34
+//	at /home/santucco/work/go/test/test.go:23 (main.Foo)
+//	at /home/santucco/work/go/test/test.go:34 (main.AnotherFoo)
+//	prefix: main.Foo: output only for debTrace level, tracer: trace.Tracer{TraceLevel:0x7, Prefix:"prefix: ", FrameSource:true, TraceSource:true, CallersSource:0x1, ...}
+//	at /home/santucco/work/go/test/test.go:25 (main.Foo)
+//	at /home/santucco/work/go/test/test.go:34 (main.AnotherFoo)
+//	prefix: main.Foo: output only for debTrace|debThis level, tracer: trace.Tracer{TraceLevel:0x7, Prefix:"prefix: ", FrameSource:true, TraceSource:true, CallersSource:0x1, ...}
+//	at /home/santucco/work/go/test/test.go:26 (main.Foo)
+//	at /home/santucco/work/go/test/test.go:34 (main.AnotherFoo)
 //	prefix: main.Foo: exit
-//	at /home/santucco/work/go/test/test.go:27
-//	at /home/santucco/work/go/test/test.go:34
+//	at /home/santucco/work/go/test/test.go:27 (main.Foo)
+//	at /home/santucco/work/go/test/test.go:34 (main.AnotherFoo)
+//
+// When a caller has been inlined by the compiler, the frames of the inlined
+// calls are expanded rather than collapsed into their enclosing function, so
+// an inlined helper still gets its own "at" line.
 package trace
 
 import (
-	"os"
 	"fmt"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -65,15 +71,19 @@ const (
 )
 
 type Tracer struct {
-	TraceLevel    uint   // The current trace level
-	Prefix        string // The prefix of output strings.
-	FrameSource   bool   // The flag of printing frames for frame traces
-	TraceSource   bool   // The flag of printing frames for traces
-	CallersSource uint   // The count of printing frames
-}
+	TraceLevel     uint   // The current trace level
+	Prefix         string // The prefix of output strings.
+	FrameSource    bool   // The flag of printing frames for frame traces
+	TraceSource    bool   // The flag of printing frames for traces
+	CallersSource  uint   // The count of extra logical frames to print (post inline-expansion)
+	PanicStack     bool   // The flag of printing a parsed goroutine dump instead of a plain "panic exit" line
+	PanicAggregate bool   // The flag of dumping and grouping every goroutine; ignored when PanicStack is false
+	Format         string // The format of frame traces (see the Format* consts); when empty, the sink's own Format is used, or FormatDefault if that is empty too
+	Indent         string // The string repeated per call depth to indent nested Enter/Exit traces; no indentation when empty
 
-var outchan chan string
-var donechan chan bool
+	sink  Sink     // The sink this writes to, see SetSink and Sink; the package's default stderr sink is used when nil
+	depth sync.Map // gid (int64) -> *int64, the current Enter/Exit call depth per goroutine, used for Indent
+}
 
 func init() {
 	Start()
@@ -84,7 +94,11 @@ func (this *Tracer) Enter() uintptr {
 	if (this.TraceLevel & Frame) == 0 {
 		return 0
 	}
-	return this.trace(2, "enter", this.FrameSource)
+	pc := this.trace(2, Frame, "enter", this.FrameSource)
+	if this.Indent != "" {
+		this.adjustDepth(currentGoroutineID(), 1)
+	}
+	return pc
 }
 
 // Exit in a conjunction with defer prints a trace about an exit from the frame
@@ -92,44 +106,31 @@ func (this *Tracer) Exit(pc uintptr) {
 	if (this.TraceLevel&Frame) == 0 {
 		return
 	}
-	
+	if this.Indent != "" {
+		this.adjustDepth(currentGoroutineID(), -1)
+	}
+
 	if x := recover(); x != nil {
-		this.trace(2, "panic exit", false)
+		if this.PanicStack {
+			this.tracePanic()
+		} else {
+			this.trace(2, Frame, "panic exit", false)
+		}
+		this.flushSink()
 		panic(x)
 	} else {
-		this.trace(2, "exit", this.FrameSource)
+		this.trace(2, Frame, "exit", this.FrameSource)
 	}
 }
 
-// Start starts tracing
-func Start() {
-	if outchan != nil {
-		return
-	}
-	outchan = make(chan string, 10)
-	go func() {
-		for true {
-			if s, ok := <-outchan; ok {
-				fmt.Fprint(os.Stderr, s)
-			} else {
-				break
-			}
-		}
-		donechan <- true
-	}()
-}
-
-// Stop stops all tracing and wait until all trace messages are printed
-func Stop(){
-	if outchan == nil {
-		return
+// flushSink blocks until every record written so far has reached the
+// underlying sink, when the sink supports it. Exit calls this before
+// re-panicking so a panic dump isn't lost to an async sink's backlog when
+// the process aborts.
+func (this *Tracer) flushSink() {
+	if f, ok := this.Sink().(flusher); ok {
+		f.Flush()
 	}
-	donechan = make(chan bool)
-	close(outchan)
-	<- donechan
-	close(donechan)
-	outchan = nil
-	donechan = nil
 }
 
 // Trace prints a formatted message, f is a format of the message, v are interfaces with data fields.
@@ -137,7 +138,7 @@ func (this *Tracer) Trace(l uint, f string, v ...interface{}) {
 	if (l&this.TraceLevel) == 0 || (l & ^this.TraceLevel) != 0 {
 		return
 	}
-	this.trace(2, fmt.Sprintf(f, v...), this.TraceSource)
+	this.trace(2, l, fmt.Sprintf(f, v...), this.TraceSource)
 }
 
 // TraceFunc repeatedly calls f until second result is true and prints obtained strings
@@ -146,40 +147,89 @@ func (this *Tracer) TraceFunc(l uint, f func() (string, bool)) {
 		return
 	}
 	for s, ok := f(); ok; s, ok = f() {
-		this.trace(2, s, this.TraceSource)
+		this.trace(2, l, s, this.TraceSource)
 	}
 }
 
-func (this *Tracer) trace(c int, msg string, src bool) uintptr {
-	if outchan == nil {
+// frameAt walks the logical (post inline-expansion) call stack skipping the
+// first skip frames and returns the frame found there, together with the
+// still-open runtime.CallersFrames iterator positioned right after it, so the
+// caller can keep pulling further logical frames from the same stack.
+func frameAt(skip int, extra int) (runtime.Frame, *runtime.Frames, bool) {
+	pcs := make([]uintptr, skip+extra+1)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var frame runtime.Frame
+	var ok bool
+	for i := 0; i <= skip; i++ {
+		frame, ok = frames.Next()
+		if !ok && i < skip {
+			return runtime.Frame{}, frames, false
+		}
+	}
+	return frame, frames, frame.PC != 0
+}
+
+// formatPlain is used for records emitted with src == false: a plain
+// "prefix name: message" line regardless of the Tracer's configured Format.
+const formatPlain = "%P%n: %m\n"
+
+func (this *Tracer) trace(c int, level uint, msg string, src bool) uintptr {
+	sink := this.Sink()
+	if sink == nil {
 		return 0
 	}
-	pc, _, _, ok := runtime.Caller(c)
+	format := this.Format
+	if format == "" {
+		format = FormatDefault
+	}
+	hasFrame := format == FormatJSON || strings.Contains(format, "%A")
+	extra := 0
+	if src && hasFrame {
+		extra = int(this.CallersSource)
+	}
+	gid := currentGoroutineID()
+	prefix := this.Prefix
+	if this.Indent != "" {
+		if depth := this.currentDepth(gid); depth > 0 {
+			prefix = strings.Repeat(this.Indent, int(depth)) + prefix
+		}
+	}
+	frame, frames, ok := frameAt(c, extra)
 	if !ok {
-		outchan <- this.Prefix + msg + "\n"
+		sink.Write(Record{Level: level, Time: time.Now(), Gid: gid, Prefix: prefix, Message: msg, Format: formatPlain})
 		return 0
 	}
-	fnc := runtime.FuncForPC(pc)
-	if fnc == nil {
-		outchan <- this.Prefix + msg + "\n"
-		return pc
+	pc := frame.PC
+	record := Record{
+		Level:    level,
+		Time:     time.Now(),
+		Gid:      gid,
+		Prefix:   prefix,
+		Function: frame.Function,
+		File:     frame.File,
+		Line:     frame.Line,
+		Message:  msg,
+		Format:   this.Format,
 	}
-	name := fnc.Name()
 	if !src {
-		outchan <- fmt.Sprintf("%s%s: %s\n", this.Prefix, name, msg)
+		record.Format = formatPlain
+		sink.Write(record)
 		return pc
 	}
-	file, line := fnc.FileLine(pc)
-	s := fmt.Sprintf("%s%s: %s\n\tat %s:%d\n", this.Prefix, name, msg, file, line)
-	if this.CallersSource > 0 {
-		i := c + 1
-		c += int(this.CallersSource)
-		for _, file, line, ok := runtime.Caller(i); ok && i < c; _, file, line, ok = runtime.Caller(i) {
-			s += fmt.Sprintf("\tat %s:%d\n", file, line)
-			i++
+	if hasFrame {
+		for i := 0; i < int(this.CallersSource); i++ {
+			var more bool
+			frame, more = frames.Next()
+			if frame.PC == 0 {
+				break
+			}
+			record.Frames = append(record.Frames, StackFrame{Function: frame.Function, File: frame.File, Line: frame.Line})
+			if !more {
+				break
+			}
 		}
 	}
-
-	outchan <- s
+	sink.Write(record)
 	return pc
 }